@@ -7,14 +7,38 @@ import (
 	"net/http"
 	"net/url"
 	"os"
-	"strings"
 	"time"
 
 	"github.com/dghubble/go-twitter/twitter"
 	"github.com/dghubble/oauth1"
 	"github.com/hashicorp/errwrap"
+
+	"github.com/LittleLightLittleFire/PBoC/ratelimit"
 )
 
+// weiboHomeTimelineEndpoint identifies the Weibo home timeline endpoint in
+// the rate limit tracker.
+const weiboHomeTimelineEndpoint = "weibo:home_timeline"
+
+// twitterStatusUpdateEndpoint identifies the Twitter statuses/update endpoint
+// in the rate limit tracker.
+const twitterStatusUpdateEndpoint = "twitter:statuses_update"
+
+// limiter tracks the remaining quota for each endpoint we call, so sources
+// can spread requests evenly across the window instead of sleeping blind.
+var limiter = ratelimit.NewTracker()
+
+// RateLimitError indicates the API rejected a request because its quota was
+// exhausted, as distinct from a network or decoding failure.
+type RateLimitError struct {
+	Endpoint string
+	Reset    time.Time
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("rate limited on %v until %v", e.Endpoint, e.Reset)
+}
+
 // BotConfig store the bot configuration.
 // Read https://www.cs.cmu.edu/~lingwang/weiboguide/ to get set up
 // Create an app and authorize the app on your behalf, just like Twitter
@@ -26,8 +50,53 @@ type BotConfig struct {
 	TwitterConsumerSecret string `json:"twitter_consumer_secret"`
 	TwitterAccessToken    string `json:"twitter_access_token"`
 	TwitterTokenSecret    string `json:"twitter_token_secret"`
+
+	// IngestSource selects where statuses come from: "weibo" (default)
+	// polls the Weibo home timeline, "twitter-stream" mirrors a Twitter
+	// filter stream instead.
+	IngestSource string `json:"ingest_source"`
+	// TwitterStreamTrack is the set of keywords/handles to track when
+	// IngestSource is "twitter-stream".
+	TwitterStreamTrack []string `json:"twitter_stream_track"`
+
+	// DBPath is where the BoltDB store is kept. Defaults to "bot.db".
+	DBPath string `json:"db_path"`
+
+	// Sinks selects which Publishers to fan generated posts out to.
+	// Defaults to ["twitter"].
+	Sinks []string `json:"sinks"`
+
+	MastodonServer       string `json:"mastodon_server"`
+	MastodonClientID     string `json:"mastodon_client_id"`
+	MastodonClientSecret string `json:"mastodon_client_secret"`
+	MastodonAccessToken  string `json:"mastodon_access_token"`
+
+	TelegramBotToken string `json:"telegram_bot_token"`
+	TelegramChatID   string `json:"telegram_chat_id"`
+
+	WebhookURL string `json:"webhook_url"`
+
+	// RulesPath points at a YAML/JSON rules file; empty uses the default
+	// ruleset, which reproduces the bot's original filtering behaviour.
+	RulesPath string `json:"rules_path"`
+
+	// MaxAttachments caps how many images are relayed per status.
+	// MaxAttachmentBytes caps the total size of those images combined, not
+	// any one of them individually. Zero uses the defaults.
+	MaxAttachments     int   `json:"max_attachments"`
+	MaxAttachmentBytes int64 `json:"max_attachment_bytes"`
 }
 
+// postedTTL is how long a status ID is remembered in the dedupe store.
+const postedTTL = 7 * 24 * time.Hour
+
+// sweepInterval is how often expired posted-state entries are purged from
+// the store in the background.
+const sweepInterval = time.Hour
+
+var store Store
+var ruleSet *RuleSet
+
 var cfg BotConfig
 var httpClient = http.Client{
 	Timeout: 10 * time.Second,
@@ -36,6 +105,7 @@ var httpClient = http.Client{
 // Status defines a Weibo status.
 type Status struct {
 	User struct {
+		ID         int64  `json:"id"`
 		Name       string `json:"name"`
 		ScreenName string `json:"screen_name"`
 	} `json:"user"`
@@ -43,6 +113,11 @@ type Status struct {
 	RawCreatedAt string `json:"created_at"`
 	Text         string `json:"text"`
 
+	PicURLs []struct {
+		ThumbnailPic string `json:"thumbnail_pic"`
+	} `json:"pic_urls"`
+	OriginalPic string `json:"original_pic"`
+
 	CreatedAt time.Time `json:"-"`
 }
 
@@ -64,13 +139,23 @@ func loadConfig() (config BotConfig, err error) {
 	return config, nil
 }
 
-func fetchJSON(url string, v interface{}) error {
+func fetchJSON(endpoint, url string, v interface{}) error {
 	resp, err := httpClient.Get(url)
 	if err != nil {
 		return errwrap.Wrapf("failed to GET: {{err}}", err)
 	}
 	defer resp.Body.Close()
 
+	limiter.UpdateFromHeaders(endpoint, resp.Header)
+
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusForbidden {
+		reset := time.Now()
+		if l, ok := limiter.Limit(endpoint); ok {
+			reset = l.Reset
+		}
+		return &RateLimitError{Endpoint: endpoint, Reset: reset}
+	}
+
 	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
 		return errwrap.Wrapf("failed to failed to decode body: {{err}}", err)
 	}
@@ -100,7 +185,10 @@ func fetchStatus(sinceID int64) ([]Status, error) {
 		Error    string   `json:"error"`
 	}
 
-	if err := fetchJSON(url.String(), &timeline); err != nil {
+	if err := fetchJSON(weiboHomeTimelineEndpoint, url.String(), &timeline); err != nil {
+		if _, ok := err.(*RateLimitError); ok {
+			return nil, err
+		}
 		return nil, errwrap.Wrapf("failed to fetch status: {{err}}", err)
 	}
 
@@ -129,7 +217,8 @@ func main() {
 	}
 
 	// Login to Twitter
-	client := twitter.NewClient(oauth1.NewConfig(cfg.TwitterConsumerKey, cfg.TwitterConsumerSecret).Client(oauth1.NoContext, oauth1.NewToken(cfg.TwitterAccessToken, cfg.TwitterTokenSecret)))
+	oauthClient := oauth1.NewConfig(cfg.TwitterConsumerKey, cfg.TwitterConsumerSecret).Client(oauth1.NoContext, oauth1.NewToken(cfg.TwitterAccessToken, cfg.TwitterTokenSecret))
+	client := twitter.NewClient(oauthClient)
 	user, _, err := client.Accounts.VerifyCredentials(nil)
 	if err != nil {
 		log.Fatal("Failed to verify Twitter credentials:", err)
@@ -137,77 +226,112 @@ func main() {
 
 	log.Println("Logged in as:", user.Name)
 
-	// Load China timezone so we can throttle our requests
-	loc, err := time.LoadLocation("Asia/Shanghai")
-	if err != nil {
-		log.Fatal("Failed to load CST time:", err)
+	dbPath := cfg.DBPath
+	if dbPath == "" {
+		dbPath = "bot.db"
 	}
-
-	// Fetch the initial status to get the ID
-	statuses, err := fetchStatus(0)
+	boltStore, err := OpenBoltStore(dbPath)
 	if err != nil {
-		log.Println("Error fetching weibo:", err)
-	}
-
-	var start int64
-	if len(statuses) > 0 {
-		start = statuses[0].ID
+		log.Fatal("Failed to open store:", err)
 	}
-	log.Println("Initial ID set:", start)
-
-	for {
-		statuses, err = fetchStatus(start)
+	defer boltStore.Close()
+	store = boltStore
+
+	go func() {
+		ticker := time.NewTicker(sweepInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if removed, err := boltStore.SweepExpired(); err != nil {
+				log.Println("Failed to sweep posted store:", err)
+			} else if removed > 0 {
+				log.Println("Swept expired posted entries:", removed)
+			}
+		}
+	}()
+
+	var source Source
+	switch cfg.IngestSource {
+	case "twitter-stream":
+		source = NewTwitterStreamSource(client, cfg.TwitterStreamTrack)
+	case "", "weibo":
+		start, err := store.GetCursor()
 		if err != nil {
-			log.Println("Error fetching weibo:", err)
-		} else {
-			log.Println("Loaded:", len(statuses), "statuses")
+			log.Fatal("Failed to read cursor:", err)
 		}
 
-		for _, status := range statuses {
-			// Check the source of the status update
-			if strings.Contains(status.User.ScreenName, "火币网") ||
-				strings.Contains(status.User.ScreenName, "OKCoin") ||
-				strings.Contains(status.User.ScreenName, "YourBTCC") {
-				// If the source is an exchange, filter the fluff
-
-				if !(strings.Contains(status.Text, "公告") || // Announcement
-					strings.Contains(status.Text, "尊敬") || // "Dear"
-					strings.Contains(status.Text, "用户")) { // "Customer"
-					continue
-				}
-			} else {
-				// News report, must contain the keyword bitcoin
-				if !strings.Contains(status.Text, "比特币") { // bitcoin
-					continue
-				}
+		if start == 0 {
+			// No cursor yet, fetch the initial status to get the ID
+			statuses, err := fetchStatus(0)
+			if err != nil {
+				log.Println("Error fetching weibo:", err)
 			}
 
-			// Generate the tweet
-			runes := ([]rune)(fmt.Sprintf("%v: %v", status.User.Name, status.Text))
-			if len(runes) > 140 {
-				runes = []rune(string(runes[:140-4]) + " ...")
+			if len(statuses) > 0 {
+				start = statuses[0].ID
 			}
+		}
+		log.Println("Initial ID set:", start)
 
-			// Send the tweet
-			if tweet, _, err := client.Statuses.Update(string(runes), nil); err != nil {
-				log.Println("Failed to tweet:", status)
-			} else {
-				log.Printf("Sent tweet: %v: '%v'\n", tweet.IDStr, status)
+		poll := NewWeiboPollSource(start)
+		poll.OnCursor = func(sinceID int64) {
+			if err := store.SetCursor(sinceID); err != nil {
+				log.Println("Failed to persist cursor:", err)
 			}
 		}
+		source = poll
+	default:
+		log.Fatal("Unknown ingest source:", cfg.IngestSource)
+	}
 
-		if len(statuses) > 0 {
-			start = statuses[0].ID
-			log.Println("Last ID:", start)
-		}
+	publishers, err := buildPublishers(cfg, client, oauthClient)
+	if err != nil {
+		log.Fatal("Failed to build publishers:", err)
+	}
 
-		// Reduce fetch time during periods of low activity, Weibo's per day request quota is very low
-		// They keeps banning us: they allow ~470 requests a day
-		beijingTime := time.Now().In(loc)
-		if beijingTime.Hour() >= 7 && beijingTime.Hour() <= 19 { // 8:00 to 18:00 are the work hours
-			time.Sleep(3 * 60 * time.Second)
-		} else {
-			time.Sleep(5 * 60 * time.Second)
+	ruleSet, err = LoadRuleSet(cfg.RulesPath)
+	if err != nil {
+		log.Fatal("Failed to load rules:", err)
+	}
+
+	statusCh := make(chan Status)
+	stop := make(chan struct{})
+	go func() {
+		if err := source.Run(statusCh, stop); err != nil {
+			log.Fatal("Source stopped:", err)
 		}
+	}()
+
+	for status := range statusCh {
+		processStatus(publishers, status)
+	}
+}
+
+// processStatus filters a single status and, if it passes, publishes it to
+// every enabled sink.
+func processStatus(publishers []Publisher, status Status) {
+	if posted, err := store.WasPosted(status.ID); err != nil {
+		log.Println("Failed to check posted state:", err)
+	} else if posted {
+		return
+	}
+
+	ok, body := ruleSet.Evaluate(status)
+	if !ok {
+		return
+	}
+
+	maxAttachments := cfg.MaxAttachments
+	if maxAttachments == 0 {
+		maxAttachments = defaultMaxAttachments
+	}
+	maxAttachmentBytes := cfg.MaxAttachmentBytes
+	if maxAttachmentBytes == 0 {
+		maxAttachmentBytes = defaultMaxAttachmentBytes
+	}
+	media := fetchMedia(status, maxAttachments, maxAttachmentBytes)
+
+	publishAll(publishers, body, media)
+	if err := store.MarkPosted(status.ID, postedTTL); err != nil {
+		log.Println("Failed to mark posted:", err)
 	}
 }
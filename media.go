@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+
+	"github.com/hashicorp/errwrap"
+)
+
+// defaultMaxAttachments and defaultMaxAttachmentBytes apply when BotConfig
+// doesn't set MaxAttachments/MaxAttachmentBytes. defaultMaxAttachmentBytes is
+// a total budget shared across all of a status's attachments.
+const (
+	defaultMaxAttachments     = 4
+	defaultMaxAttachmentBytes = 5 << 20 // 5 MiB, Twitter's image upload limit
+)
+
+// mediaURLs returns the attached image URLs for a status, if any. Weibo
+// only gives us the original-resolution URL for the first image
+// (original_pic); the rest come back as thumbnails.
+func (s Status) mediaURLs() []string {
+	var urls []string
+	if s.OriginalPic != "" {
+		urls = append(urls, s.OriginalPic)
+	}
+
+	for i, p := range s.PicURLs {
+		if i == 0 && s.OriginalPic != "" {
+			continue
+		}
+		if p.ThumbnailPic != "" {
+			urls = append(urls, p.ThumbnailPic)
+		}
+	}
+
+	return urls
+}
+
+// fetchMedia downloads up to maxAttachments images attached to status,
+// sharing a total budget of maxBytes across all of them. A download failure
+// or an attachment that would blow the remaining budget is logged and
+// skipped rather than aborting the whole status.
+func fetchMedia(status Status, maxAttachments int, maxBytes int64) [][]byte {
+	if maxAttachments <= 0 {
+		return nil
+	}
+
+	urls := status.mediaURLs()
+	if len(urls) > maxAttachments {
+		urls = urls[:maxAttachments]
+	}
+
+	var media [][]byte
+	remaining := maxBytes
+	for _, u := range urls {
+		if remaining <= 0 {
+			log.Println("Attachment byte budget exhausted, skipping remaining attachments")
+			break
+		}
+
+		data, err := fetchMediaBytes(u, remaining)
+		if err != nil {
+			log.Println("Failed to download attachment, skipping:", err)
+			continue
+		}
+		media = append(media, data)
+		remaining -= int64(len(data))
+	}
+	return media
+}
+
+// fetchMediaBytes downloads url, refusing (rather than silently truncating)
+// if the body turns out to be larger than maxBytes.
+func fetchMediaBytes(url string, maxBytes int64) ([]byte, error) {
+	resp, err := httpClient.Get(url)
+	if err != nil {
+		return nil, errwrap.Wrapf("failed to GET media: {{err}}", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.ContentLength > 0 && resp.ContentLength > maxBytes {
+		return nil, fmt.Errorf("media too large: %v bytes exceeds budget of %v", resp.ContentLength, maxBytes)
+	}
+
+	// Read one byte past the budget so an oversized body (or one lacking a
+	// trustworthy Content-Length) is detected instead of being silently
+	// truncated into corrupt image data.
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxBytes+1))
+	if err != nil {
+		return nil, errwrap.Wrapf("failed to read media body: {{err}}", err)
+	}
+	if int64(len(data)) > maxBytes {
+		return nil, fmt.Errorf("media too large: exceeds budget of %v bytes", maxBytes)
+	}
+	return data, nil
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/dghubble/go-twitter/twitter"
+	"github.com/hashicorp/errwrap"
+	"github.com/mattn/go-mastodon"
+)
+
+// publishRetries is how many attempts in total a Publisher makes at a publish
+// before giving up, with a short fixed delay between attempts.
+const publishRetries = 3
+
+// publishRetryDelay is the delay between publish retries.
+const publishRetryDelay = 5 * time.Second
+
+// Publisher sends a generated post body to a destination network.
+type Publisher interface {
+	// Name identifies the publisher in logs.
+	Name() string
+	// Publish sends body to the destination, retrying transient failures.
+	Publish(body string) error
+}
+
+// MediaPublisher is implemented by Publishers that can attach media to a
+// post. Publishers that don't implement it are sent text-only.
+type MediaPublisher interface {
+	Publisher
+	// PublishMedia sends body with media attached. Implementations should
+	// fall back to a text-only post if the media upload fails.
+	PublishMedia(body string, media [][]byte) error
+}
+
+// publishWithRetry calls publish up to publishRetries times, stopping early
+// on success.
+func publishWithRetry(name string, publish func() error) error {
+	var err error
+	for attempt := 1; attempt <= publishRetries; attempt++ {
+		if err = publish(); err == nil {
+			return nil
+		}
+		log.Printf("Publish to %v failed (attempt %v/%v): %v\n", name, attempt, publishRetries, err)
+		if attempt < publishRetries {
+			time.Sleep(publishRetryDelay)
+		}
+	}
+	return errwrap.Wrapf(fmt.Sprintf("failed to publish to %v after retries: ", name)+"{{err}}", err)
+}
+
+// twitterMediaUploadURL is Twitter's media upload endpoint. go-twitter has
+// no client support for it, so TwitterPublisher posts to it directly.
+const twitterMediaUploadURL = "https://upload.twitter.com/1.1/media/upload.json"
+
+// TwitterPublisher posts statuses via the Twitter API.
+type TwitterPublisher struct {
+	Client *twitter.Client
+
+	// HTTPClient is the OAuth1-signing http.Client backing Client, used to
+	// hit media/upload.json directly since go-twitter doesn't wrap it.
+	HTTPClient *http.Client
+}
+
+// Name implements Publisher.
+func (p *TwitterPublisher) Name() string { return "twitter" }
+
+// Publish implements Publisher.
+func (p *TwitterPublisher) Publish(body string) error {
+	return publishWithRetry(p.Name(), func() error {
+		_, resp, err := p.Client.Statuses.Update(truncateRunes(body, 140), nil)
+		if resp != nil {
+			limiter.UpdateFromHeaders(twitterStatusUpdateEndpoint, resp.Header)
+		}
+		return err
+	})
+}
+
+// PublishMedia implements MediaPublisher, uploading each image first and
+// attaching the resulting media IDs to the status update. If any upload
+// fails, it logs the failure and falls back to a text-only post.
+func (p *TwitterPublisher) PublishMedia(body string, media [][]byte) error {
+	return publishWithRetry(p.Name(), func() error {
+		params := &twitter.StatusUpdateParams{}
+
+		var mediaIDs []int64
+		for _, m := range media {
+			mediaID, err := p.uploadMedia(m)
+			if err != nil {
+				log.Println("Failed to upload media, falling back to text-only:", err)
+				mediaIDs = nil
+				break
+			}
+			mediaIDs = append(mediaIDs, mediaID)
+		}
+		if len(mediaIDs) > 0 {
+			params.MediaIds = mediaIDs
+		}
+
+		_, resp, err := p.Client.Statuses.Update(truncateRunes(body, 140), params)
+		if resp != nil {
+			limiter.UpdateFromHeaders(twitterStatusUpdateEndpoint, resp.Header)
+		}
+		return err
+	})
+}
+
+// uploadMedia POSTs m to Twitter's media/upload.json as multipart/form-data
+// and returns the resulting media ID, for attaching to a status update.
+// go-twitter doesn't wrap this endpoint, so we build the request by hand.
+func (p *TwitterPublisher) uploadMedia(m []byte) (int64, error) {
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+
+	part, err := w.CreateFormFile("media", "media")
+	if err != nil {
+		return 0, errwrap.Wrapf("failed to create multipart field: {{err}}", err)
+	}
+	if _, err := part.Write(m); err != nil {
+		return 0, errwrap.Wrapf("failed to write media bytes: {{err}}", err)
+	}
+	if err := w.Close(); err != nil {
+		return 0, errwrap.Wrapf("failed to close multipart writer: {{err}}", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, twitterMediaUploadURL, &buf)
+	if err != nil {
+		return 0, errwrap.Wrapf("failed to build media upload request: {{err}}", err)
+	}
+	req.Header.Set("Content-Type", w.FormDataContentType())
+
+	resp, err := p.HTTPClient.Do(req)
+	if err != nil {
+		return 0, errwrap.Wrapf("failed to POST media upload: {{err}}", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("media upload returned status %v", resp.StatusCode)
+	}
+
+	var result struct {
+		MediaID int64 `json:"media_id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return 0, errwrap.Wrapf("failed to decode media upload response: {{err}}", err)
+	}
+	return result.MediaID, nil
+}
+
+// truncateRunes shortens body to at most n runes, appending " ..." in place
+// of whatever was cut.
+func truncateRunes(body string, n int) string {
+	runes := []rune(body)
+	if len(runes) <= n {
+		return body
+	}
+	return string(runes[:n-4]) + " ..."
+}
+
+// MastodonPublisher posts statuses via a Mastodon instance.
+type MastodonPublisher struct {
+	Client *mastodon.Client
+}
+
+// NewMastodonPublisher builds a MastodonPublisher from the bot config.
+func NewMastodonPublisher(cfg BotConfig) *MastodonPublisher {
+	client := mastodon.NewClient(&mastodon.Config{
+		Server:       cfg.MastodonServer,
+		ClientID:     cfg.MastodonClientID,
+		ClientSecret: cfg.MastodonClientSecret,
+		AccessToken:  cfg.MastodonAccessToken,
+	})
+	return &MastodonPublisher{Client: client}
+}
+
+// Name implements Publisher.
+func (p *MastodonPublisher) Name() string { return "mastodon" }
+
+// Publish implements Publisher.
+func (p *MastodonPublisher) Publish(body string) error {
+	return publishWithRetry(p.Name(), func() error {
+		_, err := p.Client.PostStatus(context.Background(), &mastodon.Toot{Status: body})
+		return err
+	})
+}
+
+// TelegramPublisher posts statuses to a Telegram chat via the Bot API.
+type TelegramPublisher struct {
+	BotToken string
+	ChatID   string
+}
+
+// Name implements Publisher.
+func (p *TelegramPublisher) Name() string { return "telegram" }
+
+// Publish implements Publisher.
+func (p *TelegramPublisher) Publish(body string) error {
+	return publishWithRetry(p.Name(), func() error {
+		form := url.Values{
+			"chat_id": []string{p.ChatID},
+			"text":    []string{body},
+		}
+		resp, err := httpClient.PostForm(fmt.Sprintf("https://api.telegram.org/bot%v/sendMessage", p.BotToken), form)
+		if err != nil {
+			return errwrap.Wrapf("failed to POST to telegram: {{err}}", err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("telegram returned status %v", resp.StatusCode)
+		}
+		return nil
+	})
+}
+
+// WebhookPublisher posts a JSON body to a generic HTTP endpoint.
+type WebhookPublisher struct {
+	URL string
+}
+
+// Name implements Publisher.
+func (p *WebhookPublisher) Name() string { return "webhook" }
+
+// Publish implements Publisher.
+func (p *WebhookPublisher) Publish(body string) error {
+	return publishWithRetry(p.Name(), func() error {
+		payload, err := json.Marshal(struct {
+			Text string `json:"text"`
+		}{Text: body})
+		if err != nil {
+			return errwrap.Wrapf("failed to marshal webhook payload: {{err}}", err)
+		}
+
+		resp, err := httpClient.Post(p.URL, "application/json", bytes.NewReader(payload))
+		if err != nil {
+			return errwrap.Wrapf("failed to POST to webhook: {{err}}", err)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode >= 400 {
+			return fmt.Errorf("webhook returned status %v", resp.StatusCode)
+		}
+		return nil
+	})
+}
+
+// buildPublishers constructs the enabled Publishers from cfg.Sinks, falling
+// back to Twitter alone to preserve existing behaviour when unset.
+// oauthClient is the OAuth1-signing http.Client backing twitterClient; it's
+// needed to hit media/upload.json directly since go-twitter has no media
+// upload support of its own.
+func buildPublishers(cfg BotConfig, twitterClient *twitter.Client, oauthClient *http.Client) ([]Publisher, error) {
+	sinks := cfg.Sinks
+	if len(sinks) == 0 {
+		sinks = []string{"twitter"}
+	}
+
+	var publishers []Publisher
+	for _, sink := range sinks {
+		switch sink {
+		case "twitter":
+			publishers = append(publishers, &TwitterPublisher{Client: twitterClient, HTTPClient: oauthClient})
+		case "mastodon":
+			publishers = append(publishers, NewMastodonPublisher(cfg))
+		case "telegram":
+			publishers = append(publishers, &TelegramPublisher{BotToken: cfg.TelegramBotToken, ChatID: cfg.TelegramChatID})
+		case "webhook":
+			publishers = append(publishers, &WebhookPublisher{URL: cfg.WebhookURL})
+		default:
+			return nil, fmt.Errorf("unknown sink: %v", sink)
+		}
+	}
+
+	return publishers, nil
+}
+
+// publishAll fans a post out to every publisher, logging each independently
+// so one sink's failure doesn't block the others.
+func publishAll(publishers []Publisher, body string, media [][]byte) {
+	for _, p := range publishers {
+		var err error
+		if mp, ok := p.(MediaPublisher); ok && len(media) > 0 {
+			err = mp.PublishMedia(body, media)
+		} else {
+			err = p.Publish(body)
+		}
+
+		if err != nil {
+			log.Println("Failed to publish:", err)
+		} else {
+			log.Printf("Published to %v: '%v'\n", p.Name(), body)
+		}
+	}
+}
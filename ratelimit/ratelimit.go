@@ -0,0 +1,100 @@
+// Package ratelimit tracks per-endpoint API quotas so callers can spread
+// requests evenly across the window instead of guessing at a fixed sleep.
+package ratelimit
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Limit is the most recently observed rate limit window for an endpoint.
+type Limit struct {
+	Remaining int
+	Reset     time.Time
+}
+
+// Tracker is a concurrency-safe map of endpoint -> latest observed Limit,
+// mirroring twittergo's ClientWrapper.RateLimit().
+type Tracker struct {
+	mu     sync.RWMutex
+	limits map[string]Limit
+}
+
+// NewTracker creates an empty Tracker.
+func NewTracker() *Tracker {
+	return &Tracker{limits: make(map[string]Limit)}
+}
+
+// Update records the latest limit observed for endpoint.
+func (t *Tracker) Update(endpoint string, limit Limit) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.limits[endpoint] = limit
+}
+
+// UpdateFromHeaders parses the remaining-quota headers and records them for
+// endpoint. Weibo uses X-RateLimit-Remaining/X-RateLimit-Reset; Twitter's
+// v1.1 API uses X-Rate-Limit-Remaining/X-Rate-Limit-Reset. It is a no-op if
+// neither pair of headers is present.
+func (t *Tracker) UpdateFromHeaders(endpoint string, h http.Header) {
+	remaining := h.Get("X-RateLimit-Remaining")
+	reset := h.Get("X-RateLimit-Reset")
+	if remaining == "" || reset == "" {
+		remaining = h.Get("X-Rate-Limit-Remaining")
+		reset = h.Get("X-Rate-Limit-Reset")
+	}
+	if remaining == "" || reset == "" {
+		return
+	}
+
+	r, err := strconv.Atoi(remaining)
+	if err != nil {
+		return
+	}
+	resetSec, err := strconv.ParseInt(reset, 10, 64)
+	if err != nil {
+		return
+	}
+
+	t.Update(endpoint, Limit{Remaining: r, Reset: time.Unix(resetSec, 0)})
+}
+
+// Limit returns the last observed limit for endpoint, if any.
+func (t *Tracker) Limit(endpoint string) (Limit, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	l, ok := t.limits[endpoint]
+	return l, ok
+}
+
+// NextInterval computes how long to wait before the next request to
+// endpoint so the remaining quota is spread evenly across the window until
+// reset. It stretches the interval as quota runs low, and tightens it again
+// once the window resets. fallback is returned when no limit has been
+// observed yet, or once the window has already reset.
+func (t *Tracker) NextInterval(endpoint string, fallback time.Duration) time.Duration {
+	limit, ok := t.Limit(endpoint)
+	if !ok {
+		return fallback
+	}
+
+	remainingWindow := time.Until(limit.Reset)
+	if remainingWindow <= 0 {
+		return fallback
+	}
+
+	// Quota is exhausted: the worst possible moment to keep polling at
+	// fallback cadence, since that's exactly what gets an endpoint banned.
+	// Wait out the rest of the window instead.
+	if limit.Remaining <= 0 {
+		return remainingWindow
+	}
+
+	interval := remainingWindow / time.Duration(limit.Remaining)
+	if interval < 0 {
+		return fallback
+	}
+	return interval
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"regexp"
+	"strconv"
+	"text/template"
+	"unicode"
+
+	"github.com/hashicorp/errwrap"
+	"gopkg.in/yaml.v2"
+)
+
+// RuleAction decides what happens to a Status that matches a Rule.
+type RuleAction string
+
+// The set of actions a Rule can take.
+const (
+	ActionInclude         RuleAction = "include"
+	ActionExclude         RuleAction = "exclude"
+	ActionRewriteTemplate RuleAction = "rewrite-template"
+)
+
+// Rule matches a Status against a set of conditions and, if every condition
+// that's set matches, applies Action. Rules are evaluated in order and the
+// first one that matches wins; a matching rule whose Action is none of the
+// known actions is passed over.
+type Rule struct {
+	ScreenName string  `yaml:"screen_name" json:"screen_name"`
+	Text       string  `yaml:"text" json:"text"`
+	UserIDs    []int64 `yaml:"user_ids" json:"user_ids"`
+	MinLength  int     `yaml:"min_length" json:"min_length"`
+	Language   string  `yaml:"language" json:"language"`
+
+	Action   RuleAction `yaml:"action" json:"action"`
+	Template string     `yaml:"template" json:"template"`
+
+	screenNameRe *regexp.Regexp
+	textRe       *regexp.Regexp
+	tmpl         *template.Template
+}
+
+// compile precompiles the rule's regexes and template.
+func (r *Rule) compile() error {
+	if r.ScreenName != "" {
+		re, err := regexp.Compile(r.ScreenName)
+		if err != nil {
+			return errwrap.Wrapf("failed to compile screen_name pattern: {{err}}", err)
+		}
+		r.screenNameRe = re
+	}
+
+	if r.Text != "" {
+		re, err := regexp.Compile(r.Text)
+		if err != nil {
+			return errwrap.Wrapf("failed to compile text pattern: {{err}}", err)
+		}
+		r.textRe = re
+	}
+
+	if r.Template != "" {
+		t, err := template.New("rule").Parse(r.Template)
+		if err != nil {
+			return errwrap.Wrapf("failed to parse template: {{err}}", err)
+		}
+		r.tmpl = t
+	}
+
+	return nil
+}
+
+// matches reports whether status satisfies every condition set on r.
+func (r *Rule) matches(status Status, lang string) bool {
+	if r.screenNameRe != nil && !r.screenNameRe.MatchString(status.User.ScreenName) {
+		return false
+	}
+
+	if r.textRe != nil && !r.textRe.MatchString(status.Text) {
+		return false
+	}
+
+	if len(r.UserIDs) > 0 {
+		var whitelisted bool
+		for _, id := range r.UserIDs {
+			if id == status.User.ID {
+				whitelisted = true
+				break
+			}
+		}
+		if !whitelisted {
+			return false
+		}
+	}
+
+	if r.MinLength > 0 && len([]rune(status.Text)) < r.MinLength {
+		return false
+	}
+
+	if r.Language != "" && r.Language != lang {
+		return false
+	}
+
+	return true
+}
+
+// templateData is what {{.User.Name}}, {{.Text}} and {{.URL}} resolve to
+// inside a Rule's template.
+type templateData struct {
+	User struct {
+		Name       string
+		ScreenName string
+	}
+	Text string
+	URL  string
+}
+
+// RuleSet is an ordered list of Rules plus the template used when a
+// matching rule doesn't specify its own.
+type RuleSet struct {
+	Rules           []*Rule `yaml:"rules" json:"rules"`
+	DefaultTemplate string  `yaml:"default_template" json:"default_template"`
+
+	defaultTmpl *template.Template
+}
+
+// defaultRulesYAML reproduces the bot's original hand-coded filter: tweet
+// exchange announcements and any non-exchange post mentioning 比特币
+// (bitcoin), and nothing else. It's used when no rules file is configured.
+const defaultRulesYAML = `
+default_template: "{{.User.Name}}: {{.Text}}"
+rules:
+  - screen_name: "(火币网|OKCoin|YourBTCC)"
+    text: "(公告|尊敬|用户)"
+    action: include
+  - screen_name: "(火币网|OKCoin|YourBTCC)"
+    action: exclude
+  - text: "比特币"
+    action: include
+`
+
+// LoadRuleSet reads a RuleSet from a YAML or JSON file at path. An empty
+// path loads the default ruleset, which matches the bot's original
+// behaviour.
+func LoadRuleSet(path string) (*RuleSet, error) {
+	if path == "" {
+		return parseRuleSet([]byte(defaultRulesYAML))
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errwrap.Wrapf("failed to read rules file: {{err}}", err)
+	}
+
+	return parseRuleSet(data)
+}
+
+func parseRuleSet(data []byte) (*RuleSet, error) {
+	var rs RuleSet
+	if err := yaml.Unmarshal(data, &rs); err != nil {
+		return nil, errwrap.Wrapf("failed to parse ruleset: {{err}}", err)
+	}
+
+	if rs.DefaultTemplate == "" {
+		rs.DefaultTemplate = "{{.User.Name}}: {{.Text}}"
+	}
+	t, err := template.New("default").Parse(rs.DefaultTemplate)
+	if err != nil {
+		return nil, errwrap.Wrapf("failed to parse default_template: {{err}}", err)
+	}
+	rs.defaultTmpl = t
+
+	for _, r := range rs.Rules {
+		if err := r.compile(); err != nil {
+			return nil, err
+		}
+	}
+
+	return &rs, nil
+}
+
+// Evaluate returns whether status should be published and, if so, the
+// rendered body to publish.
+func (rs *RuleSet) Evaluate(status Status) (bool, string) {
+	lang := detectLanguage(status.Text)
+
+	for _, r := range rs.Rules {
+		if !r.matches(status, lang) {
+			continue
+		}
+
+		switch r.Action {
+		case ActionExclude:
+			return false, ""
+		case ActionInclude, ActionRewriteTemplate:
+			return true, rs.render(status, r.tmpl)
+		}
+	}
+
+	return false, ""
+}
+
+// render executes tmpl (or the ruleset default, if tmpl is nil) against
+// status.
+func (rs *RuleSet) render(status Status, tmpl *template.Template) string {
+	if tmpl == nil {
+		tmpl = rs.defaultTmpl
+	}
+
+	data := templateData{Text: status.Text, URL: weiboPermalink(status.ID)}
+	data.User.Name = status.User.Name
+	data.User.ScreenName = status.User.ScreenName
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		log.Println("Failed to render template, falling back to default:", err)
+		buf.Reset()
+		rs.defaultTmpl.Execute(&buf, data)
+	}
+
+	return buf.String()
+}
+
+// weiboPermalink returns the public URL for a Weibo status ID.
+func weiboPermalink(id int64) string {
+	return "https://weibo.com/" + strconv.FormatInt(id, 10)
+}
+
+// detectLanguage is a deliberately simple heuristic: any Han (Chinese
+// character) rune marks the text as Chinese, otherwise it's treated as
+// English.
+func detectLanguage(text string) string {
+	for _, r := range text {
+		if unicode.Is(unicode.Han, r) {
+			return "zh"
+		}
+	}
+	return "en"
+}
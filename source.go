@@ -0,0 +1,172 @@
+package main
+
+import (
+	"log"
+	"math/rand"
+	"time"
+
+	"github.com/dghubble/go-twitter/twitter"
+	"github.com/hashicorp/errwrap"
+)
+
+// Source produces a stream of normalized statuses for the filter/tweet
+// pipeline to consume. Implementations are responsible for their own
+// polling or streaming cadence and for reconnecting on failure.
+type Source interface {
+	// Run fetches statuses until stop is closed, sending each one on out.
+	// Run blocks until stop is closed or an unrecoverable error occurs.
+	Run(out chan<- Status, stop <-chan struct{}) error
+}
+
+// fallbackInterval is used when we have no observed rate limit yet.
+const fallbackInterval = 3 * 60 * time.Second
+
+// WeiboPollSource polls Weibo's home timeline, spacing requests out based on
+// the remaining-quota headers Weibo returns so the daily allowance is spread
+// evenly across the window instead of sleeping a fixed amount.
+type WeiboPollSource struct {
+	// OnCursor, if set, is called after the sinceID advances so callers can
+	// persist it.
+	OnCursor func(sinceID int64)
+
+	since int64
+}
+
+// NewWeiboPollSource creates a poll source seeded with the given sinceID.
+func NewWeiboPollSource(sinceID int64) *WeiboPollSource {
+	return &WeiboPollSource{since: sinceID}
+}
+
+// Run implements Source.
+func (s *WeiboPollSource) Run(out chan<- Status, stop <-chan struct{}) error {
+	for {
+		statuses, err := fetchStatus(s.since)
+
+		var sleep time.Duration
+		if rlErr, ok := err.(*RateLimitError); ok {
+			log.Println("Weibo rate limited us, backing off until:", rlErr.Reset)
+			sleep = time.Until(rlErr.Reset)
+		} else {
+			if err != nil {
+				log.Println("Error fetching weibo:", err)
+			} else {
+				log.Println("Loaded:", len(statuses), "statuses")
+			}
+
+			for _, status := range statuses {
+				select {
+				case out <- status:
+				case <-stop:
+					return nil
+				}
+			}
+
+			if len(statuses) > 0 {
+				s.since = statuses[0].ID
+				log.Println("Last ID:", s.since)
+				if s.OnCursor != nil {
+					s.OnCursor(s.since)
+				}
+			}
+
+			sleep = limiter.NextInterval(weiboHomeTimelineEndpoint, fallbackInterval)
+		}
+
+		if sleep < 0 {
+			sleep = 0
+		}
+
+		select {
+		case <-time.After(sleep):
+		case <-stop:
+			return nil
+		}
+	}
+}
+
+// TwitterStreamSource mirrors a Twitter filter stream in near-real time,
+// reconnecting with exponential backoff when the stream drops.
+type TwitterStreamSource struct {
+	Client *twitter.Client
+	Track  []string
+
+	// MaxBackoff caps the reconnect delay; NewTwitterStreamSource sets it to
+	// 2 minutes.
+	MaxBackoff time.Duration
+}
+
+// NewTwitterStreamSource creates a stream source tracking the given
+// keywords/handles.
+func NewTwitterStreamSource(client *twitter.Client, track []string) *TwitterStreamSource {
+	return &TwitterStreamSource{Client: client, Track: track, MaxBackoff: 2 * time.Minute}
+}
+
+// Run implements Source. It reconnects whenever the underlying stream ends,
+// backing off exponentially (with jitter) between attempts.
+func (s *TwitterStreamSource) Run(out chan<- Status, stop <-chan struct{}) error {
+	backoff := time.Second
+
+	for {
+		stream, err := s.Client.Streams.Filter(&twitter.StreamFilterParams{
+			Track:         s.Track,
+			StallWarnings: twitter.Bool(true),
+		})
+		if err != nil {
+			return errwrap.Wrapf("failed to open twitter stream: {{err}}", err)
+		}
+
+		demux := twitter.NewSwitchDemux()
+		demux.Tweet = func(tweet *twitter.Tweet) {
+			status := Status{
+				ID:   tweet.ID,
+				Text: tweet.Text,
+			}
+			status.User.Name = tweet.User.Name
+			status.User.ScreenName = tweet.User.ScreenName
+			status.User.ID = tweet.User.ID
+
+			select {
+			case out <- status:
+			case <-stop:
+			}
+		}
+
+		// demux.HandleChan is the only consumer of stream.Messages; done is
+		// closed once it returns after the stream drains and disconnects, so
+		// we don't race a second receiver against it.
+		done := make(chan struct{})
+		go func() {
+			demux.HandleChan(stream.Messages)
+			close(done)
+		}()
+
+		// Stream.Messages is closed once the stream disconnects, whether
+		// from a network error or us calling Stop below.
+		select {
+		case <-stop:
+			stream.Stop()
+			return nil
+		case <-done:
+		}
+
+		log.Println("Twitter stream disconnected, reconnecting in", backoff)
+		select {
+		case <-time.After(backoff + jitter(backoff)):
+		case <-stop:
+			return nil
+		}
+
+		backoff *= 2
+		if backoff > s.MaxBackoff {
+			backoff = s.MaxBackoff
+		}
+	}
+}
+
+// jitter returns a random duration in [0, d/2) to avoid reconnect storms.
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(d) / 2))
+}
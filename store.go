@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/hashicorp/errwrap"
+)
+
+var (
+	cursorBucket = []byte("cursor")
+	postedBucket = []byte("posted")
+
+	cursorKey = []byte("sinceID")
+)
+
+// Store persists the ingestion cursor and dedupe state across restarts, so
+// we don't re-read the initial timeline window or re-tweet items we've
+// already posted.
+type Store interface {
+	// GetCursor returns the last processed Weibo status ID, or 0 if none
+	// has been recorded yet.
+	GetCursor() (int64, error)
+	// SetCursor records the last processed Weibo status ID.
+	SetCursor(id int64) error
+
+	// MarkPosted records that id has been tweeted, expiring after ttl.
+	MarkPosted(id int64, ttl time.Duration) error
+	// WasPosted reports whether id has already been tweeted and not yet
+	// expired.
+	WasPosted(id int64) (bool, error)
+
+	// Close releases the underlying resources.
+	Close() error
+}
+
+// BoltStore is a Store backed by an embedded BoltDB file.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+// OpenBoltStore opens (creating if necessary) a BoltStore at path.
+func OpenBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, errwrap.Wrapf("failed to open bolt db: {{err}}", err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(cursorBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(postedBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, errwrap.Wrapf("failed to create buckets: {{err}}", err)
+	}
+
+	return &BoltStore{db: db}, nil
+}
+
+// GetCursor implements Store.
+func (s *BoltStore) GetCursor() (int64, error) {
+	var id int64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(cursorBucket).Get(cursorKey)
+		if v == nil {
+			return nil
+		}
+		id = int64(binary.BigEndian.Uint64(v))
+		return nil
+	})
+	if err != nil {
+		return 0, errwrap.Wrapf("failed to read cursor: {{err}}", err)
+	}
+	return id, nil
+}
+
+// SetCursor implements Store.
+func (s *BoltStore) SetCursor(id int64) error {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(id))
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(cursorBucket).Put(cursorKey, buf)
+	})
+	if err != nil {
+		return errwrap.Wrapf("failed to write cursor: {{err}}", err)
+	}
+	return nil
+}
+
+// MarkPosted implements Store.
+func (s *BoltStore) MarkPosted(id int64, ttl time.Duration) error {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(time.Now().Add(ttl).Unix()))
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(postedBucket).Put(postedKey(id), buf)
+	})
+	if err != nil {
+		return errwrap.Wrapf("failed to mark posted: {{err}}", err)
+	}
+	return nil
+}
+
+// WasPosted implements Store. Expired entries are treated as not posted and
+// deleted on the way out, so a repeatedly-seen ID doesn't linger forever.
+func (s *BoltStore) WasPosted(id int64) (bool, error) {
+	var posted bool
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(postedBucket)
+		v := b.Get(postedKey(id))
+		if v == nil {
+			return nil
+		}
+
+		expiry := int64(binary.BigEndian.Uint64(v))
+		if time.Now().Unix() >= expiry {
+			return b.Delete(postedKey(id))
+		}
+		posted = true
+		return nil
+	})
+	if err != nil {
+		return false, errwrap.Wrapf("failed to read posted state: {{err}}", err)
+	}
+	return posted, nil
+}
+
+// SweepExpired deletes every expired entry from the posted bucket,
+// regardless of whether WasPosted is ever called for it again. Without this
+// an ID that's never re-seen would sit in the bucket forever even after its
+// TTL passed.
+func (s *BoltStore) SweepExpired() (int, error) {
+	now := time.Now().Unix()
+
+	var removed int
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		c := tx.Bucket(postedBucket).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if int64(binary.BigEndian.Uint64(v)) > now {
+				continue
+			}
+			if err := c.Delete(); err != nil {
+				return err
+			}
+			removed++
+		}
+		return nil
+	})
+	if err != nil {
+		return removed, errwrap.Wrapf("failed to sweep posted bucket: {{err}}", err)
+	}
+	return removed, nil
+}
+
+// Close implements Store.
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+func postedKey(id int64) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(id))
+	return buf
+}